@@ -0,0 +1,214 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeServer is a minimal, single-process stand-in for a NATS server: just
+// enough of the text protocol (INFO/CONNECT/PING/SUB/UNSUB/PUB/HPUB) to
+// exercise a Conn end-to-end in these tests, without depending on a real
+// nats-server binary. Subject matching is exact, and queue groups deliver
+// to every member rather than load-balancing - neither distinction matters
+// to the http.go tests this backs.
+type fakeServer struct {
+	ln net.Listener
+
+	mu   sync.Mutex
+	subs map[string][]*fakeSub
+}
+
+type fakeSub struct {
+	sid int64
+	w   *fakeConnWriter
+}
+
+// fakeConnWriter serializes writes to one accepted connection, since
+// multiple PUBs from other connections can be forwarded to it concurrently.
+type fakeConnWriter struct {
+	mu sync.Mutex
+	bw *bufio.Writer
+}
+
+func (w *fakeConnWriter) write(b []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.bw.Write(b)
+	w.bw.Flush()
+}
+
+// startFakeServer starts a fakeServer on loopback and returns its "nats://"
+// URL. It is stopped automatically when t's test ends.
+func startFakeServer(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	fs := &fakeServer{ln: ln, subs: make(map[string][]*fakeSub)}
+	go fs.acceptLoop()
+	t.Cleanup(func() { ln.Close() })
+
+	return "nats://" + ln.Addr().String()
+}
+
+func (fs *fakeServer) acceptLoop() {
+	for {
+		c, err := fs.ln.Accept()
+		if err != nil {
+			return
+		}
+		go fs.serve(c)
+	}
+}
+
+func (fs *fakeServer) serve(c net.Conn) {
+	defer c.Close()
+
+	w := &fakeConnWriter{bw: bufio.NewWriter(c)}
+	w.write([]byte(`INFO {"headers":true,"header_compression":true,"header_table_size":4096}` + "\r\n"))
+
+	br := bufio.NewReader(c)
+	var mySids []int64
+
+	defer func() {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		for subject, subs := range fs.subs {
+			kept := subs[:0]
+			for _, s := range subs {
+				if s.w != w {
+					kept = append(kept, s)
+				}
+			}
+			fs.subs[subject] = kept
+		}
+	}()
+
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case strings.HasPrefix(line, "CONNECT "):
+			// Nothing to negotiate for these tests.
+		case line == "PING":
+			w.write([]byte("PONG\r\n"))
+		case strings.HasPrefix(line, "SUB "):
+			fields := strings.Fields(line)
+			subject := fields[1]
+			sid, _ := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+			mySids = append(mySids, sid)
+			fs.mu.Lock()
+			fs.subs[subject] = append(fs.subs[subject], &fakeSub{sid: sid, w: w})
+			fs.mu.Unlock()
+		case strings.HasPrefix(line, "UNSUB "):
+			fields := strings.Fields(line)
+			sid, _ := strconv.ParseInt(fields[1], 10, 64)
+			fs.mu.Lock()
+			for subject, subs := range fs.subs {
+				kept := subs[:0]
+				for _, s := range subs {
+					if s.sid != sid || s.w != w {
+						kept = append(kept, s)
+					}
+				}
+				fs.subs[subject] = kept
+			}
+			fs.mu.Unlock()
+		case strings.HasPrefix(line, "HPUB "):
+			if err := fs.relay(br, line, true); err != nil {
+				return
+			}
+		case strings.HasPrefix(line, "PUB "):
+			if err := fs.relay(br, line, false); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// relay reads a PUB/HPUB payload off br and forwards it as MSG/HMSG to
+// every subscriber currently registered on the published subject.
+func (fs *fakeServer) relay(br *bufio.Reader, line string, hdr bool) error {
+	fields := strings.Fields(line)
+
+	var subject, reply string
+	var hdrLen, totalLen int
+	var err error
+
+	switch {
+	case hdr && len(fields) == 4:
+		subject = fields[1]
+		hdrLen, err = strconv.Atoi(fields[2])
+		if err == nil {
+			totalLen, err = strconv.Atoi(fields[3])
+		}
+	case hdr && len(fields) == 5:
+		subject, reply = fields[1], fields[2]
+		hdrLen, err = strconv.Atoi(fields[3])
+		if err == nil {
+			totalLen, err = strconv.Atoi(fields[4])
+		}
+	case !hdr && len(fields) == 3:
+		subject = fields[1]
+		totalLen, err = strconv.Atoi(fields[2])
+	case !hdr && len(fields) == 4:
+		subject, reply = fields[1], fields[2]
+		totalLen, err = strconv.Atoi(fields[3])
+	default:
+		return fmt.Errorf("fakeServer: malformed protocol line %q", line)
+	}
+	if err != nil {
+		return err
+	}
+
+	payload := make([]byte, totalLen+2)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return err
+	}
+	payload = payload[:totalLen]
+
+	fs.mu.Lock()
+	subs := append([]*fakeSub(nil), fs.subs[subject]...)
+	fs.mu.Unlock()
+
+	for _, s := range subs {
+		var op string
+		switch {
+		case hdr && reply != "":
+			op = fmt.Sprintf("HMSG %s %d %s %d %d\r\n", subject, s.sid, reply, hdrLen, totalLen)
+		case hdr:
+			op = fmt.Sprintf("HMSG %s %d %d %d\r\n", subject, s.sid, hdrLen, totalLen)
+		case reply != "":
+			op = fmt.Sprintf("MSG %s %d %s %d\r\n", subject, s.sid, reply, totalLen)
+		default:
+			op = fmt.Sprintf("MSG %s %d %d\r\n", subject, s.sid, totalLen)
+		}
+		s.w.write(append([]byte(op), append(payload, '\r', '\n')...))
+	}
+	return nil
+}
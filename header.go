@@ -0,0 +1,125 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+)
+
+// errMalformedHeader is returned by ReadHeader when a header block does not
+// start with its version line or contains a line that cannot be split into
+// a name and a value. A block that ends before its terminating blank line
+// yields the underlying read error (io.EOF for a truncated buffer) instead.
+var errMalformedHeader = errors.New("nats: malformed header")
+
+// Clone returns a deep copy of h, or nil if h is nil. It matches the
+// semantics of http.Header.Clone: each key's value slice is copied rather
+// than shared, and the original key case is preserved. Handlers that retain
+// a Msg (or want to mutate its Header before re-publishing, as in a
+// multi-hop pipeline) should clone first if the original is still in use
+// elsewhere.
+func (h Header) Clone() Header {
+	if h == nil {
+		return nil
+	}
+	clone := make(Header, len(h))
+	for k, vv := range h {
+		if vv == nil {
+			clone[k] = nil
+			continue
+		}
+		v := make([]string, len(vv))
+		copy(v, vv)
+		clone[k] = v
+	}
+	return clone
+}
+
+// Write serializes h to w using the NATS wire format for headers: the
+// "NATS/1.0" version line, one CRLF-delimited "Name: value" line per value
+// (names written verbatim, not canonicalized), and a final blank line.
+func (h Header) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString("NATS/1.0\r\n"); err != nil {
+		return err
+	}
+	for k, values := range h {
+		for _, v := range values {
+			if _, err := bw.WriteString(k); err != nil {
+				return err
+			}
+			if _, err := bw.WriteString(": "); err != nil {
+				return err
+			}
+			if _, err := bw.WriteString(v); err != nil {
+				return err
+			}
+			if _, err := bw.WriteString("\r\n"); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := bw.WriteString("\r\n"); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ReadHeader parses a NATS wire-format header block (as written by
+// Header.Write, or as received inline on a message) from r and returns the
+// decoded Header. It stops after the blank line that terminates the block,
+// so a caller sharing r with the rest of the message parser can continue
+// reading the payload right after. An inline status/description line, used
+// on no-payload status messages such as "NATS/1.0 503 No Responders", is
+// preserved as the "Status" and "Description" header entries. Received
+// plaintext header blocks reach this same function through
+// (*Conn).processMsgLine.
+func ReadHeader(r *bufio.Reader) (Header, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "NATS/1.0") {
+		return nil, errMalformedHeader
+	}
+
+	h := Header{}
+	if status := strings.TrimSpace(strings.TrimPrefix(line, "NATS/1.0")); status != "" {
+		parts := strings.SplitN(status, " ", 2)
+		h.Set("Status", parts[0])
+		if len(parts) == 2 {
+			h.Set("Description", parts[1])
+		}
+	}
+
+	for {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			return nil, errMalformedHeader
+		}
+		h.Add(name, value)
+	}
+	return h, nil
+}
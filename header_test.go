@@ -0,0 +1,61 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestHeaderCloneNil(t *testing.T) {
+	var h Header
+	if clone := h.Clone(); clone != nil {
+		t.Fatalf("expected Clone of a nil Header to be nil, got %v", clone)
+	}
+}
+
+func TestHeaderClonePreservesNilValues(t *testing.T) {
+	h := Header{"X-Empty": nil, "X-Set": {"value"}}
+	clone := h.Clone()
+
+	if v, ok := clone["X-Empty"]; !ok || v != nil {
+		t.Fatalf("expected X-Empty to clone to a nil slice, got %v", v)
+	}
+	if got := clone.Get("X-Set"); got != "value" {
+		t.Fatalf("expected X-Set to clone to %q, got %q", "value", got)
+	}
+
+	clone["X-Set"][0] = "mutated"
+	if got := h.Get("X-Set"); got != "value" {
+		t.Fatalf("mutating the clone must not affect the original, got %q", got)
+	}
+}
+
+func TestHeaderWriteReadRoundTrip(t *testing.T) {
+	h := Header{"X-Multi": {"a", "b"}}
+
+	var buf bytes.Buffer
+	if err := h.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	got, err := ReadHeader(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatalf("ReadHeader: %v", err)
+	}
+	if values := got.Values("X-Multi"); len(values) != 2 || values[0] != "a" || values[1] != "b" {
+		t.Fatalf("expected [a b], got %v", values)
+	}
+}
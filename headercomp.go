@@ -0,0 +1,251 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// setupHeaderCodecsLocked (re)builds nc.hdrEnc/nc.hdrDec from the most
+// recently received INFO once header compression is supported by both this
+// client and the server, and tears them down otherwise - including on a
+// reconnect to a server that no longer advertises it, so writeMsg and
+// processMsgLine fall back to the plaintext wire format automatically. The
+// table size is capped at the server's negotiated HeaderTableSize (its own
+// SETTINGS_HEADER_TABLE_SIZE-style limit), defaulting to
+// defaultHeaderTableSize on either side when unset. Called with nc.mu held.
+func (nc *Conn) setupHeaderCodecsLocked() {
+	if !nc.Opts.HeaderCompression || !nc.info.HeaderCompression {
+		nc.hdrEnc = nil
+		nc.hdrDec = nil
+		return
+	}
+
+	tableSize := uint32(defaultHeaderTableSize)
+	if nc.Opts.HeaderTableSize != 0 {
+		tableSize = nc.Opts.HeaderTableSize
+	}
+	if nc.info.HeaderTableSize != 0 && nc.info.HeaderTableSize < tableSize {
+		tableSize = nc.info.HeaderTableSize
+	}
+
+	nc.hdrEnc = newHeaderCodec(tableSize)
+	nc.hdrDec = newHeaderCodec(tableSize)
+}
+
+// encodeHeaderBlockLocked returns the wire representation of hdr. If
+// compression was negotiated, it is the headerCompressionVersion marker
+// line followed by the HPACK-encoded block; otherwise it is the plaintext
+// NATS/1.0 format written by Header.Write, which carries its own "NATS/1.0"
+// marker line. Either way decodeHeaderBlock tells the two apart from the
+// bytes themselves, not from local connection state. Called with nc.mu
+// held.
+func (nc *Conn) encodeHeaderBlockLocked(hdr Header) ([]byte, error) {
+	if nc.hdrEnc == nil {
+		var buf bytes.Buffer
+		if err := hdr.Write(&buf); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	payload, err := nc.hdrEnc.encode(hdr)
+	if err != nil {
+		return nil, err
+	}
+	block := make([]byte, 0, len(headerCompressionVersion)+2+len(payload))
+	block = append(block, headerCompressionVersion...)
+	block = append(block, '\r', '\n')
+	block = append(block, payload...)
+	return block, nil
+}
+
+// decodeHeaderBlock parses a header block received from the wire. The
+// block's own leading marker line - headerCompressionVersion for an
+// HPACK-encoded block, "NATS/1.0..." for a plaintext one - decides how to
+// parse it, rather than the decoding side's local hdrDec state: a block
+// encoded under one compression state can otherwise race a local
+// setupHeaderCodecsLocked flip (triggered by an async INFO) and be handed
+// to the wrong parser.
+func (nc *Conn) decodeHeaderBlock(block []byte) (Header, error) {
+	line, rest, ok := bytes.Cut(block, []byte("\r\n"))
+	if !ok {
+		return nil, errMalformedHeader
+	}
+	if string(line) != headerCompressionVersion {
+		return ReadHeader(bufio.NewReader(bytes.NewReader(block)))
+	}
+
+	nc.mu.Lock()
+	dec := nc.hdrDec
+	nc.mu.Unlock()
+	if dec == nil {
+		return nil, fmt.Errorf("nats: received an HPACK-compressed header block but compression is not negotiated on this connection")
+	}
+	return dec.decode(rest)
+}
+
+// headerCompressionVersion is the header-version marker written in place
+// of "NATS/1.0" as the first line of a header block once both ends of a
+// connection have negotiated HPACK-style header compression; the rest of
+// the block is the HPACK-encoded payload rather than plaintext
+// "Name: value" lines.
+const headerCompressionVersion = "NATS/1.1"
+
+// defaultHeaderTableSize mirrors HTTP/2's SETTINGS_HEADER_TABLE_SIZE
+// default and bounds the dynamic table maintained on each side of a
+// connection unless a smaller size is negotiated.
+const defaultHeaderTableSize = 4096
+
+// natsStaticHeaderTable seeds each headerCodec's dynamic table, in addition
+// to RFC 7541's own static table, with the header names this client sees
+// most often: NATS publish options and the HTTP headers bridged by
+// HTTPTransport/HTTPHandler and TracePropagator.
+var natsStaticHeaderTable = []hpack.HeaderField{
+	{Name: "Nats-Msg-Id"},
+	{Name: "Nats-Expected-Stream"},
+	{Name: "Nats-Expected-Last-Sequence"},
+	{Name: "Authorization"},
+	{Name: "Content-Type"},
+	{Name: "traceparent"},
+	{Name: "tracestate"},
+	{Name: "baggage"},
+}
+
+// EnableHeaderCompression opts into HPACK-style header compression
+// (RFC 7541) for this connection. Compression is only used once both this
+// client and the server it is connected to advertise support for it during
+// the CONNECT/INFO handshake; otherwise, and automatically after a
+// reconnect to a server that does not advertise it, headers fall back to
+// the plaintext NATS/1.0 wire format.
+func EnableHeaderCompression() Option {
+	return func(o *Options) error {
+		o.HeaderCompression = true
+		return nil
+	}
+}
+
+// HeaderCompressionTableSize caps the HPACK dynamic table size, in bytes,
+// this client asks the server to use, mirroring HTTP/2's
+// SETTINGS_HEADER_TABLE_SIZE. It is sent during the CONNECT handshake and
+// has no effect unless combined with EnableHeaderCompression. The table
+// actually used is further capped by the server's own advertised
+// HeaderTableSize; see (*Conn).setupHeaderCodecsLocked.
+func HeaderCompressionTableSize(size uint32) Option {
+	return func(o *Options) error {
+		o.HeaderTableSize = size
+		return nil
+	}
+}
+
+// HeaderCompressionSupported reports whether both this client and the
+// currently connected server have advertised support for header
+// compression. It is re-evaluated on every INFO, mirroring the plain
+// HeadersSupported flip exercised when a server lacks header support at
+// all, so it reflects the fallback to the plaintext wire format after a
+// reconnect to a server that does not advertise compression.
+func (nc *Conn) HeaderCompressionSupported() bool {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.Opts.HeaderCompression && nc.info.HeaderCompression
+}
+
+// headerCodec maintains the pair of HPACK dynamic tables used to compress
+// and decompress header blocks for a single connection, as required by
+// RFC 7541 §2.3: the encoding and decoding directions keep independent
+// tables even though they share one connection.
+type headerCodec struct {
+	mu     sync.Mutex
+	enc    *hpack.Encoder
+	encBuf bytes.Buffer
+
+	dec     *hpack.Decoder
+	decoded []hpack.HeaderField
+}
+
+// newHeaderCodec returns a headerCodec with both tables capped at
+// tableSize bytes and seeded with natsStaticHeaderTable. A tableSize of 0
+// uses defaultHeaderTableSize.
+func newHeaderCodec(tableSize uint32) *headerCodec {
+	if tableSize == 0 {
+		tableSize = defaultHeaderTableSize
+	}
+
+	c := &headerCodec{}
+	c.enc = hpack.NewEncoder(&c.encBuf)
+	c.enc.SetMaxDynamicTableSize(tableSize)
+	c.dec = hpack.NewDecoder(tableSize, func(f hpack.HeaderField) {
+		c.decoded = append(c.decoded, f)
+	})
+
+	for _, f := range natsStaticHeaderTable {
+		c.enc.WriteField(f)
+	}
+	// Feed dec the same bytes enc just produced, so its dynamic table ends
+	// up with the seed fields at the same indices as enc's: RFC 7541's
+	// dynamic table is a shared sequence between the two ends of a stream,
+	// and diverging even one entry desyncs every index after it.
+	c.dec.Write(c.encBuf.Bytes())
+	c.decoded = c.decoded[:0]
+	c.encBuf.Reset()
+
+	return c
+}
+
+// encode returns the HPACK-encoded representation of hdr. Names are
+// written verbatim, not canonicalized, so case is preserved round-trip,
+// matching the plaintext header block's semantics.
+func (c *headerCodec) encode(hdr Header) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.encBuf.Reset()
+	for name, values := range hdr {
+		for _, v := range values {
+			if err := c.enc.WriteField(hpack.HeaderField{Name: name, Value: v}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	out := make([]byte, c.encBuf.Len())
+	copy(out, c.encBuf.Bytes())
+	return out, nil
+}
+
+// decode parses an HPACK-encoded header block into a Header, preserving the
+// case of each name exactly as it was written.
+func (c *headerCodec) decode(block []byte) (Header, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.decoded = c.decoded[:0]
+	if _, err := c.dec.Write(block); err != nil {
+		return nil, err
+	}
+	if err := c.dec.Close(); err != nil {
+		return nil, err
+	}
+
+	hdr := Header{}
+	for _, f := range c.decoded {
+		hdr[f.Name] = append(hdr[f.Name], f.Value)
+	}
+	return hdr, nil
+}
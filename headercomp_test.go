@@ -0,0 +1,140 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestHeaderCodecRoundTrip(t *testing.T) {
+	enc := newHeaderCodec(defaultHeaderTableSize)
+	dec := newHeaderCodec(defaultHeaderTableSize)
+
+	hdr := Header{"Content-Type": {"application/json"}, "X-Request-Id": {"abc", "def"}}
+
+	block, err := enc.encode(hdr)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	got, err := dec.decode(block)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !reflect.DeepEqual(got, hdr) {
+		t.Fatalf("round trip mismatch: got %v, want %v", got, hdr)
+	}
+}
+
+func TestSetupHeaderCodecsLockedRequiresBothSides(t *testing.T) {
+	nc := &Conn{}
+
+	nc.Opts.HeaderCompression = true
+	nc.info.HeaderCompression = false
+	nc.setupHeaderCodecsLocked()
+	if nc.hdrEnc != nil || nc.hdrDec != nil {
+		t.Fatal("codecs should stay nil when the server does not advertise compression")
+	}
+
+	nc.info.HeaderCompression = true
+	nc.setupHeaderCodecsLocked()
+	if nc.hdrEnc == nil || nc.hdrDec == nil {
+		t.Fatal("codecs should be set up once both sides advertise compression")
+	}
+}
+
+func TestSetupHeaderCodecsLockedFallsBackOnReconnect(t *testing.T) {
+	nc := &Conn{}
+	nc.Opts.HeaderCompression = true
+	nc.info.HeaderCompression = true
+	nc.setupHeaderCodecsLocked()
+	if nc.hdrEnc == nil {
+		t.Fatal("expected codecs to be set up")
+	}
+
+	// Simulate a reconnect to a server that does not advertise compression.
+	nc.info.HeaderCompression = false
+	nc.setupHeaderCodecsLocked()
+	if nc.hdrEnc != nil || nc.hdrDec != nil {
+		t.Fatal("expected codecs to be torn down so writeMsg/processMsgLine fall back to plaintext")
+	}
+}
+
+func TestEncodeDecodeHeaderBlockFallsBackWithoutCompression(t *testing.T) {
+	nc := &Conn{}
+	hdr := Header{"X-Test": {"value"}}
+
+	block, err := nc.encodeHeaderBlockLocked(hdr)
+	if err != nil {
+		t.Fatalf("encodeHeaderBlockLocked: %v", err)
+	}
+
+	got, err := nc.decodeHeaderBlock(block)
+	if err != nil {
+		t.Fatalf("decodeHeaderBlock: %v", err)
+	}
+	if got.Get("X-Test") != "value" {
+		t.Fatalf("expected plaintext fallback round trip, got %v", got)
+	}
+}
+
+// TestEncodeDecodeHeaderBlockSelfDescribing encodes a block while
+// compression is negotiated, then decodes it after a local INFO-triggered
+// setupHeaderCodecsLocked flip has torn hdrDec back down - the exact race
+// reported against the prior version, which decided the format from local
+// hdrDec state rather than from a marker in the bytes. Because the block says
+// NATS/1.1 regardless of local state, it must fail with an error instead of
+// being misparsed as a plaintext block.
+func TestEncodeDecodeHeaderBlockSelfDescribing(t *testing.T) {
+	nc := &Conn{}
+	nc.Opts.HeaderCompression = true
+	nc.info.HeaderCompression = true
+	nc.setupHeaderCodecsLocked()
+
+	hdr := Header{"X-Test": {"value"}}
+	block, err := nc.encodeHeaderBlockLocked(hdr)
+	if err != nil {
+		t.Fatalf("encodeHeaderBlockLocked: %v", err)
+	}
+	if !bytes.HasPrefix(block, []byte(headerCompressionVersion+"\r\n")) {
+		t.Fatalf("expected block to start with the %q marker, got %q", headerCompressionVersion, block)
+	}
+
+	// A peer's block is in flight while an async INFO flips compression
+	// off locally.
+	nc.mu.Lock()
+	nc.info.HeaderCompression = false
+	nc.setupHeaderCodecsLocked()
+	nc.mu.Unlock()
+
+	if _, err := nc.decodeHeaderBlock(block); err == nil {
+		t.Fatal("expected an error decoding a compressed block once hdrDec has been torn down, not a silent misparse")
+	}
+}
+
+func TestSetupHeaderCodecsLockedCapsTableSizeToServer(t *testing.T) {
+	nc := &Conn{}
+	nc.Opts.HeaderCompression = true
+	nc.Opts.HeaderTableSize = 8192
+	nc.info.HeaderCompression = true
+	nc.info.HeaderTableSize = 128
+
+	nc.setupHeaderCodecsLocked()
+
+	if got := nc.hdrEnc.enc.MaxDynamicTableSize(); got != 128 {
+		t.Fatalf("expected the server's smaller HeaderTableSize to cap the table, got %d", got)
+	}
+}
@@ -0,0 +1,337 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+// Header names used to carry the HTTP envelope of a bridged request or
+// response across a Msg. Everything else in Header is the original HTTP
+// header block, copied verbatim (no canonicalization) in both directions.
+// Trailers ride along the same header block: a trailer named "X-Checksum"
+// crosses as "Trailer:X-Checksum" (http.TrailerPrefix), the same convention
+// net/http itself uses for a ResponseWriter that sets trailers without
+// pre-declaring them, so values - not just names - survive the hop.
+const (
+	httpMethodHeader = "Nats-Http-Method"
+	httpURLHeader    = "Nats-Http-Url"
+	httpProtoHeader  = "Nats-Http-Proto"
+	httpStatusHeader = "Nats-Http-Status"
+	httpObjectHeader = "Nats-Http-Object"
+)
+
+// defaultHTTPBridgeTimeout bounds RoundTrip when the request's context has
+// no deadline of its own.
+const defaultHTTPBridgeTimeout = 30 * time.Second
+
+// defaultMaxInlineBody is the largest request/response body sent inline in
+// a Msg's payload before HTTPTransport falls back to ObjectStore.
+const defaultMaxInlineBody = 1024 * 1024
+
+// HTTPTransport implements http.RoundTripper by marshalling an *http.Request
+// onto a NATS subject and decoding the reply Msg into an *http.Response. It
+// lets an http.Client, and any http.RoundTripper middleware built around it
+// (auth, tracing, gzip, ...), target a NATS service as if it were an
+// ordinary HTTP endpoint.
+//
+// Pair it with HTTPHandler on the other side of the subject: pass it (with
+// its own NC and Subject for that side) to HTTPHandler, which reuses its
+// MaxInlineBody and ObjectStore settings for the reply body and for
+// resolving any request body pushed to ObjectStore.
+type HTTPTransport struct {
+	// NC is the connection used to publish requests and wait for replies.
+	NC *Conn
+
+	// Subject is the subject HTTPHandler is listening on.
+	Subject string
+
+	// Timeout bounds how long RoundTrip waits for a reply when the
+	// request's context carries no deadline. Defaults to 30s.
+	Timeout time.Duration
+
+	// MaxInlineBody is the largest body, in bytes, sent inline in the Msg
+	// payload. Bodies larger than this are written to ObjectStore and
+	// replaced on the wire with an object name. Zero means
+	// defaultMaxInlineBody.
+	MaxInlineBody int
+
+	// ObjectStore, if set, backs bodies larger than MaxInlineBody. If nil,
+	// oversized bodies return an error instead of being chunked.
+	ObjectStore ObjectStore
+}
+
+// NewHTTPTransport returns an HTTPTransport that bridges requests over nc on
+// subject, using the defaults for Timeout and MaxInlineBody.
+func NewHTTPTransport(nc *Conn, subject string) *HTTPTransport {
+	return &HTTPTransport{NC: nc, Subject: subject}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *HTTPTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.NC == nil {
+		return nil, fmt.Errorf("nats: HTTPTransport has no connection")
+	}
+
+	msg := NewMsg(t.Subject)
+	msg.Header = Header(req.Header.Clone())
+	msg.Header.Set(httpMethodHeader, req.Method)
+	msg.Header.Set(httpURLHeader, req.URL.String())
+	msg.Header.Set(httpProtoHeader, req.Proto)
+
+	if err := t.setBody(msg, req.Body); err != nil {
+		return nil, err
+	}
+
+	// req.Body has been fully drained by setBody, so any trailer a
+	// streaming request body fills in as it hits EOF (the documented
+	// net/http contract for Request.Trailer) is populated by now.
+	for k, v := range req.Trailer {
+		if len(v) > 0 {
+			msg.Header[http.TrailerPrefix+k] = v
+		}
+	}
+
+	ctx := req.Context()
+	if _, ok := ctx.Deadline(); !ok {
+		timeout := t.Timeout
+		if timeout == 0 {
+			timeout = defaultHTTPBridgeTimeout
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	reply, err := t.NC.RequestMsgWithContext(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	return t.toResponse(req, reply)
+}
+
+// setBody reads r onto msg, inlining it unless it is larger than
+// MaxInlineBody, in which case it is pushed to ObjectStore and replaced by
+// an object reference header.
+func (t *HTTPTransport) setBody(msg *Msg, r io.ReadCloser) error {
+	if r == nil {
+		return nil
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	max := t.MaxInlineBody
+	if max == 0 {
+		max = defaultMaxInlineBody
+	}
+	if len(data) <= max {
+		msg.Data = data
+		return nil
+	}
+	if t.ObjectStore == nil {
+		return fmt.Errorf("nats: body of %d bytes exceeds MaxInlineBody and no ObjectStore is configured", len(data))
+	}
+
+	name := nuid.Next()
+	if _, err := t.ObjectStore.PutBytes(name, data); err != nil {
+		return err
+	}
+	msg.Header.Set(httpObjectHeader, name)
+	return nil
+}
+
+// resolveBody returns the payload msg carries: its inline Data, or, when
+// msg.Header references an object name via httpObjectHeader (the way
+// setBody falls back for bodies over MaxInlineBody), the bytes fetched
+// from store. It is the read-side counterpart to setBody, used by both
+// toResponse and requestFromMsg so the same ObjectStore fallback works in
+// either direction of the bridge.
+func resolveBody(msg *Msg, store ObjectStore) ([]byte, error) {
+	name := msg.Header.Get(httpObjectHeader)
+	if name == "" {
+		return msg.Data, nil
+	}
+	if store == nil {
+		return nil, fmt.Errorf("nats: body stored in object %q but no ObjectStore configured", name)
+	}
+	return store.GetBytes(name)
+}
+
+// toResponse builds an *http.Response from a bridged reply Msg.
+func (t *HTTPTransport) toResponse(req *http.Request, reply *Msg) (*http.Response, error) {
+	status := http.StatusOK
+	if s := reply.Header.Get(httpStatusHeader); s != "" {
+		if v, err := strconv.Atoi(s); err == nil {
+			status = v
+		}
+	}
+
+	data, err := resolveBody(reply, t.ObjectStore)
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header(reply.Header.Clone())
+	header.Del(httpStatusHeader)
+	header.Del(httpObjectHeader)
+
+	trailer := extractTrailer(header)
+
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         reply.Header.Get(httpProtoHeader),
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       req,
+	}
+	if len(trailer) > 0 {
+		resp.Trailer = trailer
+	}
+
+	return resp, nil
+}
+
+// extractTrailer pulls any http.TrailerPrefix-prefixed entries out of
+// header, stripping the prefix, and returns them as a standalone
+// http.Header suitable for Response.Trailer or Request.Trailer.
+func extractTrailer(header http.Header) http.Header {
+	var trailer http.Header
+	for k, v := range header {
+		if !strings.HasPrefix(k, http.TrailerPrefix) {
+			continue
+		}
+		if trailer == nil {
+			trailer = make(http.Header)
+		}
+		trailer[strings.TrimPrefix(k, http.TrailerPrefix)] = v
+		header.Del(k)
+	}
+	return trailer
+}
+
+// HTTPHandler subscribes to t.Subject on t.NC and invokes handler for every
+// request bridged by an HTTPTransport, publishing the handler's response
+// back to the requester. t's MaxInlineBody and ObjectStore govern the reply
+// body exactly as they govern RoundTrip's request body, and also resolve
+// any request body the caller's HTTPTransport pushed to ObjectStore. It
+// lets a standard net/http handler (and its middleware) serve a NATS
+// subject.
+func HTTPHandler(t *HTTPTransport, handler http.Handler) (*Subscription, error) {
+	if t.NC == nil {
+		return nil, fmt.Errorf("nats: HTTPTransport has no connection")
+	}
+	return t.NC.Subscribe(t.Subject, func(msg *Msg) {
+		req, err := requestFromMsg(t, msg)
+		if err != nil {
+			respondHTTPError(t.NC, msg, err)
+			return
+		}
+
+		rec := newHTTPRecorder()
+		handler.ServeHTTP(rec, req)
+
+		reply := NewMsg(msg.Reply)
+		reply.Header = Header(rec.Header().Clone())
+		reply.Header.Set(httpStatusHeader, strconv.Itoa(rec.status))
+		if err := t.setBody(reply, ioutil.NopCloser(bytes.NewReader(rec.body.Bytes()))); err != nil {
+			respondHTTPError(t.NC, msg, err)
+			return
+		}
+		if err := t.NC.PublishMsg(reply); err != nil && !errors.Is(err, ErrHeadersNotSupported) {
+			return
+		}
+	})
+}
+
+// requestFromMsg reconstructs the *http.Request bridged by HTTPTransport
+// from the envelope headers and payload of msg, resolving the body through
+// t.ObjectStore if the sender pushed it there.
+func requestFromMsg(t *HTTPTransport, msg *Msg) (*http.Request, error) {
+	method := msg.Header.Get(httpMethodHeader)
+	if method == "" {
+		method = http.MethodPost
+	}
+	rawURL := msg.Header.Get(httpURLHeader)
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("nats: invalid bridged URL %q: %w", rawURL, err)
+	}
+
+	data, err := resolveBody(msg, t.ObjectStore)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Proto = msg.Header.Get(httpProtoHeader)
+	req.Header = http.Header(msg.Header.Clone())
+	req.Header.Del(httpMethodHeader)
+	req.Header.Del(httpURLHeader)
+	req.Header.Del(httpProtoHeader)
+
+	if trailer := extractTrailer(req.Header); len(trailer) > 0 {
+		req.Trailer = trailer
+	}
+
+	return req, nil
+}
+
+// respondHTTPError publishes a best-effort Bad Gateway reply when msg could
+// not be turned into an *http.Request, or when the handler's response body
+// could not be attached to the reply.
+func respondHTTPError(nc *Conn, msg *Msg, err error) {
+	reply := NewMsg(msg.Reply)
+	reply.Header.Set(httpStatusHeader, strconv.Itoa(http.StatusBadGateway))
+	reply.Data = []byte(err.Error())
+	nc.PublishMsg(reply)
+}
+
+// httpRecorder is a minimal http.ResponseWriter that buffers a handler's
+// output so it can be folded into a single reply Msg.
+type httpRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newHTTPRecorder() *httpRecorder {
+	return &httpRecorder{header: make(http.Header), status: http.StatusOK}
+}
+
+func (r *httpRecorder) Header() http.Header { return r.header }
+
+func (r *httpRecorder) Write(b []byte) (int, error) { return r.body.Write(b) }
+
+func (r *httpRecorder) WriteHeader(status int) { r.status = status }
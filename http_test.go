@@ -0,0 +1,222 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRequestFromMsgCarriesTrailerValues(t *testing.T) {
+	msg := NewMsg("nats.http.test")
+	msg.Header.Set(httpMethodHeader, "GET")
+	msg.Header.Set(httpURLHeader, "http://example.com/")
+	msg.Header.Set(httpProtoHeader, "HTTP/1.1")
+	msg.Header.Set(http.TrailerPrefix+"X-Checksum", "abc123")
+	msg.Data = []byte("body")
+
+	req, err := requestFromMsg(&HTTPTransport{}, msg)
+	if err != nil {
+		t.Fatalf("requestFromMsg: %v", err)
+	}
+
+	if v := req.Header.Get("X-Checksum"); v != "" {
+		t.Fatalf("trailer leaked into Header: %v", req.Header)
+	}
+
+	got := req.Trailer.Get("X-Checksum")
+	if got != "abc123" {
+		t.Fatalf("expected trailer value %q, got %q", "abc123", got)
+	}
+}
+
+func TestToResponseCarriesTrailerValues(t *testing.T) {
+	transport := &HTTPTransport{}
+
+	reply := NewMsg("_INBOX.test")
+	reply.Header.Set(httpStatusHeader, "200")
+	reply.Header.Set(httpProtoHeader, "HTTP/1.1")
+	reply.Header.Set(http.TrailerPrefix+"X-Checksum", "abc123")
+	reply.Data = []byte("OK")
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	resp, err := transport.toResponse(req, reply)
+	if err != nil {
+		t.Fatalf("toResponse: %v", err)
+	}
+
+	if v := resp.Header.Get("X-Checksum"); v != "" {
+		t.Fatalf("trailer leaked into Header: %v", resp.Header)
+	}
+	if resp.Trailer == nil {
+		t.Fatal("expected a non-nil Trailer")
+	}
+	if got := resp.Trailer.Get("X-Checksum"); got != "abc123" {
+		t.Fatalf("expected trailer value %q, got %q", "abc123", got)
+	}
+}
+
+// dialPair connects two Conns, representing an HTTPTransport caller and the
+// HTTPHandler serving it, to a shared fakeServer.
+func dialPair(t *testing.T) (transportSide, handlerSide *Conn) {
+	t.Helper()
+
+	url := startFakeServer(t)
+	transportSide, err := Connect(url)
+	if err != nil {
+		t.Fatalf("Connect (transport side): %v", err)
+	}
+	t.Cleanup(func() { transportSide.conn.Close() })
+
+	handlerSide, err = Connect(url)
+	if err != nil {
+		t.Fatalf("Connect (handler side): %v", err)
+	}
+	t.Cleanup(func() { handlerSide.conn.Close() })
+
+	return transportSide, handlerSide
+}
+
+func TestHTTPRoundTripEndToEnd(t *testing.T) {
+	nc1, nc2 := dialPair(t)
+
+	if _, err := HTTPHandler(NewHTTPTransport(nc2, "http.bridge"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Echo-Method", r.Method)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(append([]byte("echo:"), body...))
+	})); err != nil {
+		t.Fatalf("HTTPHandler: %v", err)
+	}
+
+	client := &http.Client{Transport: NewHTTPTransport(nc1, "http.bridge")}
+
+	resp, err := client.Post("http://bridge/echo", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, resp.StatusCode)
+	}
+	if got := resp.Header.Get("X-Echo-Method"); got != http.MethodPost {
+		t.Fatalf("expected X-Echo-Method %q, got %q", http.MethodPost, got)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(body) != "echo:hello" {
+		t.Fatalf("expected body %q, got %q", "echo:hello", body)
+	}
+}
+
+func TestHTTPRoundTripContextDeadlineExceeded(t *testing.T) {
+	nc1, nc2 := dialPair(t)
+
+	if _, err := HTTPHandler(NewHTTPTransport(nc2, "http.slow"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("too late"))
+	})); err != nil {
+		t.Fatalf("HTTPHandler: %v", err)
+	}
+
+	transport := NewHTTPTransport(nc1, "http.slow")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://bridge/slow", nil)
+	_, err := transport.RoundTrip(req)
+	if err == nil {
+		t.Fatal("expected RoundTrip to fail once the request's context deadline passed")
+	}
+}
+
+// fakeObjectStore is an in-memory ObjectStore used to exercise
+// HTTPTransport's MaxInlineBody fallback without a real JetStream backend.
+type fakeObjectStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	puts    int
+}
+
+func newFakeObjectStore() *fakeObjectStore {
+	return &fakeObjectStore{objects: make(map[string][]byte)}
+}
+
+func (s *fakeObjectStore) PutBytes(name string, data []byte) (*ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.puts++
+	cp := make([]byte, len(data))
+	copy(cp, data)
+	s.objects[name] = cp
+	return &ObjectInfo{Name: name}, nil
+}
+
+func (s *fakeObjectStore) GetBytes(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[name]
+	if !ok {
+		return nil, fmt.Errorf("no such object %q", name)
+	}
+	return data, nil
+}
+
+func TestHTTPRoundTripObjectStoreFallback(t *testing.T) {
+	nc1, nc2 := dialPair(t)
+	store := newFakeObjectStore()
+
+	handlerTransport := NewHTTPTransport(nc2, "http.big")
+	handlerTransport.MaxInlineBody = 4
+	handlerTransport.ObjectStore = store
+	if _, err := HTTPHandler(handlerTransport, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	})); err != nil {
+		t.Fatalf("HTTPHandler: %v", err)
+	}
+
+	transport := NewHTTPTransport(nc1, "http.big")
+	transport.MaxInlineBody = 4
+	transport.ObjectStore = store
+
+	bigBody := strings.Repeat("x", 64)
+	client := &http.Client{Transport: transport}
+
+	resp, err := client.Post("http://bridge/big", "text/plain", strings.NewReader(bigBody))
+	if err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+	defer resp.Body.Close()
+
+	got, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != bigBody {
+		t.Fatalf("expected the body to round-trip through ObjectStore unchanged, got %q", got)
+	}
+	if store.puts == 0 {
+		t.Fatal("expected the oversized request body to go through ObjectStore.PutBytes, but it never did")
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import "context"
+
+// PublishFunc publishes a single Msg under ctx. OutboundMiddleware wraps a
+// PublishFunc to observe or mutate a message - and read the caller's
+// context, e.g. to pull a trace span off it - before it reaches the wire.
+// ctx is context.Background() when published through PublishMsg, which
+// takes no context of its own, and the caller's context when published
+// through RequestMsgWithContext (or RequestMsg, which derives one from its
+// timeout).
+type PublishFunc func(ctx context.Context, msg *Msg) error
+
+// OutboundMiddleware wraps the publish path shared by PublishMsg, RequestMsg
+// and RequestMsgWithContext, so cross-cutting concerns (tracing, auditing,
+// metrics) do not have to be duplicated at every call site.
+type OutboundMiddleware func(next PublishFunc) PublishFunc
+
+// InboundMiddleware wraps a subscription's MsgHandler, running for every
+// message delivered to a Subscribe or QueueSubscribe callback.
+type InboundMiddleware func(next MsgHandler) MsgHandler
+
+// UseOutbound appends mw to the chain run before a message is handed to the
+// wire by PublishMsg, RequestMsg or RequestMsgWithContext. Middleware added
+// first runs outermost, closest to the caller.
+func (nc *Conn) UseOutbound(mw OutboundMiddleware) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.outboundMWs = append(nc.outboundMWs, mw)
+}
+
+// UseInbound appends mw to the chain run before a delivered message reaches
+// a subscription's handler. Middleware added first runs outermost.
+func (nc *Conn) UseInbound(mw InboundMiddleware) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.inboundMWs = append(nc.inboundMWs, mw)
+}
+
+// wrapOutbound folds the registered outbound middleware around publish, so
+// the first-registered middleware sees (and can short-circuit) the message
+// first.
+func (nc *Conn) wrapOutbound(publish PublishFunc) PublishFunc {
+	nc.mu.Lock()
+	mws := nc.outboundMWs
+	nc.mu.Unlock()
+	for i := len(mws) - 1; i >= 0; i-- {
+		publish = mws[i](publish)
+	}
+	return publish
+}
+
+// wrapInbound folds the registered inbound middleware around handler.
+func (nc *Conn) wrapInbound(handler MsgHandler) MsgHandler {
+	nc.mu.Lock()
+	mws := nc.inboundMWs
+	nc.mu.Unlock()
+	for i := len(mws) - 1; i >= 0; i-- {
+		handler = mws[i](handler)
+	}
+	return handler
+}
+
+// MiddlewareErrorHandler is invoked when outbound middleware cannot apply
+// itself to the current connection, for example because the server does
+// not advertise header support yet (see (*Conn).HeadersSupported).
+type MiddlewareErrorHandler func(msg *Msg, err error)
+
+// HeaderCarrier adapts a Header to the Get/Set/Keys shape expected by an
+// OpenTelemetry propagation.TextMapCarrier, so a TracePropagator (or any
+// other propagator built against that interface) can read and write trace
+// context directly on a Msg without an import on the otel module.
+type HeaderCarrier Header
+
+// Get returns the first value associated with key, or "" if there is none.
+func (c HeaderCarrier) Get(key string) string { return Header(c).Get(key) }
+
+// Set sets the header entries associated with key to the single value.
+func (c HeaderCarrier) Set(key, value string) { Header(c).Set(key, value) }
+
+// Keys lists the keys stored in this carrier.
+func (c HeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// traceHeaderKeys are the header names TracePropagator's default Inject and
+// Extract implementations round-trip: W3C trace context and baggage.
+var traceHeaderKeys = []string{"traceparent", "tracestate", "baggage"}
+
+// traceHeaderKey is the context.Context key type used by TracePropagator's
+// default Inject/Extract pair to round-trip trace header values without
+// requiring an OpenTelemetry dependency.
+type traceHeaderKey string
+
+// TracePropagator is an OutboundMiddleware/InboundMiddleware pair that
+// copies W3C trace context (traceparent, tracestate) and baggage between a
+// context.Context and a Msg's Header, so propagating trace context across
+// NATS hops requires no per-handler plumbing.
+type TracePropagator struct {
+	// Inject extracts trace values from ctx and writes them to carrier.
+	// If nil, a default implementation round-trips the values set by the
+	// matching Extract via context.Context, without requiring an
+	// OpenTelemetry dependency.
+	Inject func(ctx context.Context, carrier HeaderCarrier)
+
+	// Extract reads trace values from carrier and returns a context
+	// derived from parent carrying them. If nil, pairs with the default
+	// Inject above.
+	Extract func(parent context.Context, carrier HeaderCarrier) context.Context
+
+	// OnError is called when header propagation cannot be applied to an
+	// outbound message, most commonly ErrHeadersNotSupported. If nil, the
+	// error degrades silently: injection is dropped and the message is
+	// still published without trace headers.
+	OnError MiddlewareErrorHandler
+}
+
+func (tp *TracePropagator) inject(ctx context.Context, hdr Header) {
+	if tp.Inject != nil {
+		tp.Inject(ctx, HeaderCarrier(hdr))
+		return
+	}
+	for _, key := range traceHeaderKeys {
+		if v, ok := ctx.Value(traceHeaderKey(key)).(string); ok && v != "" {
+			hdr.Set(key, v)
+		}
+	}
+}
+
+func (tp *TracePropagator) extract(parent context.Context, hdr Header) context.Context {
+	if tp.Extract != nil {
+		return tp.Extract(parent, HeaderCarrier(hdr))
+	}
+	ctx := parent
+	for _, key := range traceHeaderKeys {
+		if v := hdr.Get(key); v != "" {
+			ctx = context.WithValue(ctx, traceHeaderKey(key), v)
+		}
+	}
+	return ctx
+}
+
+// ContextFromMsg returns a context derived from parent carrying the trace
+// context and baggage found on msg's header. It is a manual alternative to
+// registering Inbound with UseInbound, for a handler that wants to extract
+// against a parent other than msg.Context().
+func (tp *TracePropagator) ContextFromMsg(parent context.Context, msg *Msg) context.Context {
+	if msg == nil || msg.Header == nil {
+		return parent
+	}
+	return tp.extract(parent, msg.Header)
+}
+
+// Outbound returns the OutboundMiddleware that injects trace context from
+// the publish call's own ctx into the outgoing Msg's header before handing
+// it to next. Publishing via PublishMsg carries no such context, so nothing
+// is injected there; use RequestMsgWithContext (or register this after a
+// middleware that supplies one, so it runs inside it) to get real
+// propagation. If next reports ErrHeadersNotSupported, the injection is
+// treated as a no-op: OnError (if set) is notified and the message is
+// published again with the header it had before injection, rather than
+// failing the publish over a missing trace header. That second publish still
+// fails if the message carried headers of its own.
+func (tp *TracePropagator) Outbound() OutboundMiddleware {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, msg *Msg) error {
+			saved := msg.Header.Clone()
+			if msg.Header == nil {
+				msg.Header = Header{}
+			}
+			tp.inject(ctx, msg.Header)
+
+			err := next(ctx, msg)
+			if err == ErrHeadersNotSupported {
+				if tp.OnError != nil {
+					tp.OnError(msg, err)
+				}
+				msg.Header = saved
+				return next(ctx, msg)
+			}
+			return err
+		}
+	}
+}
+
+// Inbound returns the InboundMiddleware that extracts trace context and
+// baggage from the delivered Msg's header and folds them into msg.Context(),
+// so a handler recovers them with msg.Context() instead of having to call
+// ContextFromMsg itself.
+func (tp *TracePropagator) Inbound() InboundMiddleware {
+	return func(next MsgHandler) MsgHandler {
+		return func(msg *Msg) {
+			msg.ctx = tp.extract(msg.Context(), msg.Header)
+			next(msg)
+		}
+	}
+}
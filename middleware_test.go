@@ -0,0 +1,142 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWrapOutboundRunsRegisteredMiddleware(t *testing.T) {
+	nc := &Conn{}
+
+	var order []string
+	nc.UseOutbound(func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, msg *Msg) error {
+			order = append(order, "first")
+			return next(ctx, msg)
+		}
+	})
+	nc.UseOutbound(func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, msg *Msg) error {
+			order = append(order, "second")
+			return next(ctx, msg)
+		}
+	})
+
+	var published *Msg
+	publish := nc.wrapOutbound(func(ctx context.Context, msg *Msg) error {
+		published = msg
+		return nil
+	})
+
+	msg := NewMsg("test.subject")
+	if err := publish(context.Background(), msg); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if published != msg {
+		t.Fatal("innermost PublishFunc was never reached")
+	}
+	if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+		t.Fatalf("expected middleware to run in registration order, got %v", order)
+	}
+}
+
+func TestWrapInboundRunsRegisteredMiddleware(t *testing.T) {
+	nc := &Conn{}
+
+	var order []string
+	nc.UseInbound(func(next MsgHandler) MsgHandler {
+		return func(msg *Msg) {
+			order = append(order, "first")
+			next(msg)
+		}
+	})
+	nc.UseInbound(func(next MsgHandler) MsgHandler {
+		return func(msg *Msg) {
+			order = append(order, "second")
+			next(msg)
+		}
+	})
+
+	var delivered *Msg
+	handler := nc.wrapInbound(func(msg *Msg) {
+		delivered = msg
+	})
+
+	msg := NewMsg("test.subject")
+	handler(msg)
+
+	if delivered != msg {
+		t.Fatal("innermost MsgHandler was never reached")
+	}
+	if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+		t.Fatalf("expected middleware to run in registration order, got %v", order)
+	}
+}
+
+// TestTracePropagatorOutboundReadsCallerContext exercises the same call
+// shape nats.go's RequestMsgWithContext uses in production
+// (nc.wrapOutbound(nc.publishMsgDirect)(ctx, m)) and asserts that a
+// traceparent set on the caller's context actually reaches the published
+// Msg's header - the bug reported against the prior version, where Outbound
+// only ever read context.Background().
+func TestTracePropagatorOutboundReadsCallerContext(t *testing.T) {
+	nc := &Conn{}
+	tp := &TracePropagator{}
+	nc.UseOutbound(tp.Outbound())
+
+	var published *Msg
+	publish := nc.wrapOutbound(func(ctx context.Context, msg *Msg) error {
+		published = msg
+		return nil
+	})
+
+	ctx := context.WithValue(context.Background(), traceHeaderKey("traceparent"), "00-trace-01")
+	msg := NewMsg("test.subject")
+
+	if err := publish(ctx, msg); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if got := published.Header.Get("traceparent"); got != "00-trace-01" {
+		t.Fatalf("expected the caller's traceparent to reach the published Msg, got %q", got)
+	}
+}
+
+// TestTracePropagatorInboundSetsMsgContext exercises UseInbound(tp.Inbound())
+// the way HTTPHandler's Subscribe callback would see it, and asserts the
+// handler recovers the propagated trace value via msg.Context() with no
+// manual ContextFromMsg call - the bug reported against the prior version,
+// where Inbound was a bare pass-through.
+func TestTracePropagatorInboundSetsMsgContext(t *testing.T) {
+	nc := &Conn{}
+	tp := &TracePropagator{}
+	nc.UseInbound(tp.Inbound())
+
+	var gotCtx context.Context
+	handler := nc.wrapInbound(func(msg *Msg) {
+		gotCtx = msg.Context()
+	})
+
+	msg := NewMsg("test.subject")
+	msg.Header.Set("traceparent", "00-trace-02")
+	handler(msg)
+
+	if gotCtx == nil {
+		t.Fatal("handler's msg.Context() was never set")
+	}
+	if v, ok := gotCtx.Value(traceHeaderKey("traceparent")).(string); !ok || v != "00-trace-02" {
+		t.Fatalf("expected msg.Context() to carry the extracted traceparent, got %v", gotCtx)
+	}
+}
@@ -0,0 +1,630 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nats is the shared connection, message and wire-protocol core
+// that http.go, middleware.go and headercomp.go all build on: Header, Msg,
+// Subscription, Conn and the Connect/publish/subscribe paths. It is not
+// specific to any one of those files' features.
+package nats
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+var (
+	// ErrInvalidMsg is returned when a nil Msg is passed to PublishMsg,
+	// RequestMsg or RequestMsgWithContext.
+	ErrInvalidMsg = errors.New("nats: invalid message or message nil")
+
+	// ErrHeadersNotSupported is returned when a Msg carries a Header but
+	// the connected server has not advertised header support.
+	ErrHeadersNotSupported = errors.New("nats: headers not supported by this server")
+
+	// ErrConnectionClosed is returned by operations attempted on a Conn
+	// whose underlying connection has already been closed.
+	ErrConnectionClosed = errors.New("nats: connection closed")
+
+	// ErrTimeout is returned when a blocking operation exceeds its
+	// deadline without being satisfied.
+	ErrTimeout = errors.New("nats: timeout")
+)
+
+// Header represents the optional Header for a NATS message, using the same
+// representation as http.Header so it can be passed directly to code that
+// operates on one.
+type Header map[string][]string
+
+// Add adds the value to key, appending it to any existing values.
+func (h Header) Add(key, value string) {
+	h[key] = append(h[key], value)
+}
+
+// Set sets the header entries associated with key to a single value,
+// replacing any existing values.
+func (h Header) Set(key, value string) {
+	h[key] = []string{value}
+}
+
+// Get returns the first value associated with key, or "" if there is none.
+// Unlike http.Header.Get, lookup is exact: it does not canonicalize key.
+func (h Header) Get(key string) string {
+	if h == nil {
+		return ""
+	}
+	v := h[key]
+	if len(v) == 0 {
+		return ""
+	}
+	return v[0]
+}
+
+// Values returns all values associated with key, or nil if there are none.
+func (h Header) Values(key string) []string {
+	if h == nil {
+		return nil
+	}
+	return h[key]
+}
+
+// Del deletes the values associated with key.
+func (h Header) Del(key string) {
+	delete(h, key)
+}
+
+// MsgHandler is a callback invoked for each Msg delivered to a subscription
+// created by Subscribe or QueueSubscribe.
+type MsgHandler func(msg *Msg)
+
+// Msg represents a message delivered by, or to be published to, NATS.
+type Msg struct {
+	Subject string
+	Reply   string
+	Header  Header
+	Data    []byte
+	Sub     *Subscription
+
+	ctx context.Context
+}
+
+// Context returns the context associated with m, mirroring
+// http.Request.Context(). Inbound middleware such as TracePropagator.Inbound
+// sets this from values extracted off the message before the subscription's
+// handler runs; if none did, it returns context.Background().
+func (m *Msg) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+// NewMsg returns an empty Msg addressed to subject.
+func NewMsg(subject string) *Msg {
+	return &Msg{Subject: subject, Header: Header{}}
+}
+
+// Respond replies to msg with data, using the Conn the message was
+// delivered on.
+func (m *Msg) Respond(data []byte) error {
+	r := NewMsg(m.Reply)
+	r.Data = data
+	return m.respond(r)
+}
+
+// RespondMsg replies to msg with r, preserving r's Header and Data. r's
+// Subject is overwritten with msg.Reply.
+func (m *Msg) RespondMsg(r *Msg) error {
+	r.Subject = m.Reply
+	return m.respond(r)
+}
+
+func (m *Msg) respond(r *Msg) error {
+	if m.Sub == nil || m.Sub.conn == nil {
+		return ErrInvalidMsg
+	}
+	return m.Sub.conn.PublishMsg(r)
+}
+
+// Subscription represents interest in a subject, created by Subscribe or
+// QueueSubscribe.
+type Subscription struct {
+	Subject string
+	Queue   string
+
+	conn  *Conn
+	mcb   MsgHandler
+	msgCh chan *Msg
+}
+
+// NextMsg blocks until a message arrives on a synchronous subscription (one
+// created with a nil MsgHandler) or timeout elapses.
+func (s *Subscription) NextMsg(timeout time.Duration) (*Msg, error) {
+	select {
+	case m, ok := <-s.msgCh:
+		if !ok {
+			return nil, ErrConnectionClosed
+		}
+		return m, nil
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	}
+}
+
+// Unsubscribe removes this subscription's interest.
+func (s *Subscription) Unsubscribe() error {
+	return s.conn.unsubscribe(s)
+}
+
+// ObjectStore is the subset of the JetStream object store API used by
+// HTTPTransport to hold request/response bodies too large to inline.
+type ObjectStore interface {
+	// PutBytes stores data under name.
+	PutBytes(name string, data []byte) (*ObjectInfo, error)
+	// GetBytes retrieves the bytes stored under name.
+	GetBytes(name string) ([]byte, error)
+}
+
+// ObjectInfo describes an object stored in an ObjectStore.
+type ObjectInfo struct {
+	Name string
+}
+
+// Option configures the Options used by Connect.
+type Option func(*Options) error
+
+// Options holds the configuration used to establish a Conn.
+type Options struct {
+	// Url is the server URL passed to Connect.
+	Url string
+
+	// Name identifies this client to the server.
+	Name string
+
+	// HeaderCompression opts into HPACK-style header compression, set by
+	// EnableHeaderCompression. It takes effect only once the connected
+	// server also advertises support for it.
+	HeaderCompression bool
+
+	// HeaderTableSize caps the size, in bytes, of the HPACK dynamic table
+	// this client asks the server to use, set by
+	// HeaderCompressionTableSize. Zero means defaultHeaderTableSize. The
+	// server's own HeaderTableSize further caps the table actually used;
+	// see (*Conn).setupHeaderCodecsLocked.
+	HeaderTableSize uint32
+}
+
+// serverInfo is the decoded form of the server's INFO protocol message.
+type serverInfo struct {
+	Headers           bool   `json:"headers"`
+	HeaderCompression bool   `json:"header_compression"`
+	HeaderTableSize   uint32 `json:"header_table_size"`
+}
+
+// Conn represents a client connection to a NATS server.
+type Conn struct {
+	mu sync.Mutex
+
+	Opts Options
+
+	conn net.Conn
+	bw   *bufio.Writer
+	br   *bufio.Reader
+
+	info serverInfo
+
+	subs   map[int64]*Subscription
+	ssid   int64
+	closed bool
+
+	outboundMWs []OutboundMiddleware
+	inboundMWs  []InboundMiddleware
+
+	hdrEnc *headerCodec
+	hdrDec *headerCodec
+}
+
+// Connect dials url and performs the CONNECT/INFO handshake, returning a
+// ready-to-use Conn.
+func Connect(url string, options ...Option) (*Conn, error) {
+	opts := Options{Url: url}
+	for _, o := range options {
+		if o == nil {
+			continue
+		}
+		if err := o(&opts); err != nil {
+			return nil, err
+		}
+	}
+
+	c, err := net.Dial("tcp", strings.TrimPrefix(url, "nats://"))
+	if err != nil {
+		return nil, err
+	}
+
+	nc := &Conn{
+		Opts: opts,
+		conn: c,
+		bw:   bufio.NewWriter(c),
+		br:   bufio.NewReader(c),
+		subs: make(map[int64]*Subscription),
+	}
+
+	if err := nc.handshake(); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	go nc.readLoop()
+	return nc, nil
+}
+
+// handshake reads the server's INFO line, negotiates header compression,
+// and sends CONNECT.
+func (nc *Conn) handshake() error {
+	line, err := nc.br.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("nats: expected INFO, got %q", line)
+	}
+
+	var info serverInfo
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info); err != nil {
+		return err
+	}
+
+	nc.mu.Lock()
+	nc.info = info
+	nc.setupHeaderCodecsLocked()
+	nc.mu.Unlock()
+
+	connect := struct {
+		Name              string `json:"name,omitempty"`
+		Headers           bool   `json:"headers"`
+		HeaderCompression bool   `json:"header_compression,omitempty"`
+		HeaderTableSize   uint32 `json:"header_table_size,omitempty"`
+	}{
+		Name:              nc.Opts.Name,
+		Headers:           true,
+		HeaderCompression: nc.Opts.HeaderCompression,
+		HeaderTableSize:   nc.Opts.HeaderTableSize,
+	}
+	b, err := json.Marshal(connect)
+	if err != nil {
+		return err
+	}
+	if _, err := nc.bw.WriteString("CONNECT " + string(b) + "\r\n"); err != nil {
+		return err
+	}
+	return nc.bw.Flush()
+}
+
+// HeadersSupported reports whether the currently connected server
+// advertised header support in its INFO.
+func (nc *Conn) HeadersSupported() bool {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.info.Headers
+}
+
+// PublishMsg publishes m, running it through the registered outbound
+// middleware chain first. There is no caller context to thread through the
+// chain here; middleware sees context.Background(). Use
+// RequestMsgWithContext to give outbound middleware (e.g. TracePropagator)
+// access to a real context.
+func (nc *Conn) PublishMsg(m *Msg) error {
+	if m == nil {
+		return ErrInvalidMsg
+	}
+	return nc.wrapOutbound(nc.publishMsgDirect)(context.Background(), m)
+}
+
+// publishMsgDirect is the innermost PublishFunc: it writes m to the wire
+// with no middleware applied. It ignores ctx; it exists only to satisfy
+// PublishFunc's signature.
+func (nc *Conn) publishMsgDirect(ctx context.Context, m *Msg) error {
+	if len(m.Header) > 0 && !nc.HeadersSupported() {
+		return ErrHeadersNotSupported
+	}
+	return nc.writeMsg(m)
+}
+
+// RequestMsg publishes m and waits up to timeout for a reply.
+func (nc *Conn) RequestMsg(m *Msg, timeout time.Duration) (*Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return nc.RequestMsgWithContext(ctx, m)
+}
+
+// RequestMsgWithContext publishes m and waits for a reply until ctx is
+// done.
+func (nc *Conn) RequestMsgWithContext(ctx context.Context, m *Msg) (*Msg, error) {
+	if m == nil {
+		return nil, ErrInvalidMsg
+	}
+
+	reply := nc.newInbox()
+	sub, err := nc.subscribeInternal(reply, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	m.Reply = reply
+	if err := nc.wrapOutbound(nc.publishMsgDirect)(ctx, m); err != nil {
+		return nil, err
+	}
+
+	select {
+	case msg, ok := <-sub.msgCh:
+		if !ok {
+			return nil, ErrConnectionClosed
+		}
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Subscribe registers cb to be invoked for every message published to
+// subject.
+func (nc *Conn) Subscribe(subject string, cb MsgHandler) (*Subscription, error) {
+	return nc.subscribeInternal(subject, "", cb)
+}
+
+// QueueSubscribe registers cb to be invoked for messages published to
+// subject, load-balanced across every subscriber sharing queue.
+func (nc *Conn) QueueSubscribe(subject, queue string, cb MsgHandler) (*Subscription, error) {
+	return nc.subscribeInternal(subject, queue, cb)
+}
+
+// SubscribeSync creates a subscription with no callback; messages are
+// retrieved one at a time via Subscription.NextMsg.
+func (nc *Conn) SubscribeSync(subject string) (*Subscription, error) {
+	return nc.subscribeInternal(subject, "", nil)
+}
+
+func (nc *Conn) subscribeInternal(subject, queue string, cb MsgHandler) (*Subscription, error) {
+	var wrapped MsgHandler
+	if cb != nil {
+		wrapped = nc.wrapInbound(cb)
+	}
+
+	nc.mu.Lock()
+	if nc.closed {
+		nc.mu.Unlock()
+		return nil, ErrConnectionClosed
+	}
+	nc.ssid++
+	sid := nc.ssid
+	sub := &Subscription{Subject: subject, Queue: queue, conn: nc, mcb: wrapped, msgCh: make(chan *Msg, 64)}
+	nc.subs[sid] = sub
+
+	var op string
+	if queue != "" {
+		op = fmt.Sprintf("SUB %s %s %d\r\n", subject, queue, sid)
+	} else {
+		op = fmt.Sprintf("SUB %s %d\r\n", subject, sid)
+	}
+	_, err := nc.bw.WriteString(op)
+	if err == nil {
+		err = nc.bw.Flush()
+	}
+	nc.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (nc *Conn) unsubscribe(s *Subscription) error {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	for sid, sub := range nc.subs {
+		if sub != s {
+			continue
+		}
+		delete(nc.subs, sid)
+		if nc.closed {
+			return nil
+		}
+		if _, err := nc.bw.WriteString(fmt.Sprintf("UNSUB %d\r\n", sid)); err != nil {
+			return err
+		}
+		return nc.bw.Flush()
+	}
+	return nil
+}
+
+// newInbox returns a unique subject usable as a request's reply subject.
+func (nc *Conn) newInbox() string {
+	return "_INBOX." + nuid.Next()
+}
+
+// writeMsg serializes m onto the wire as PUB/HPUB, writing its Header via
+// encodeHeaderBlockLocked: HPACK-compressed if both ends negotiated it, otherwise
+// the plaintext NATS/1.0 wire format.
+func (nc *Conn) writeMsg(m *Msg) error {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	if nc.closed {
+		return ErrConnectionClosed
+	}
+
+	var hdrBlock []byte
+	if len(m.Header) > 0 {
+		b, err := nc.encodeHeaderBlockLocked(m.Header)
+		if err != nil {
+			return err
+		}
+		hdrBlock = b
+	}
+
+	var op string
+	switch {
+	case hdrBlock != nil && m.Reply != "":
+		op = fmt.Sprintf("HPUB %s %s %d %d\r\n", m.Subject, m.Reply, len(hdrBlock), len(hdrBlock)+len(m.Data))
+	case hdrBlock != nil:
+		op = fmt.Sprintf("HPUB %s %d %d\r\n", m.Subject, len(hdrBlock), len(hdrBlock)+len(m.Data))
+	case m.Reply != "":
+		op = fmt.Sprintf("PUB %s %s %d\r\n", m.Subject, m.Reply, len(m.Data))
+	default:
+		op = fmt.Sprintf("PUB %s %d\r\n", m.Subject, len(m.Data))
+	}
+
+	if _, err := nc.bw.WriteString(op); err != nil {
+		return err
+	}
+	if hdrBlock != nil {
+		if _, err := nc.bw.Write(hdrBlock); err != nil {
+			return err
+		}
+	}
+	if _, err := nc.bw.Write(m.Data); err != nil {
+		return err
+	}
+	if _, err := nc.bw.WriteString("\r\n"); err != nil {
+		return err
+	}
+	return nc.bw.Flush()
+}
+
+// readLoop consumes protocol lines from the server until the connection is
+// closed, a read error occurs, or a MSG/HMSG cannot be processed.
+func (nc *Conn) readLoop() {
+	for {
+		line, err := nc.br.ReadString('\n')
+		if err != nil {
+			nc.mu.Lock()
+			nc.closed = true
+			nc.mu.Unlock()
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			nc.mu.Lock()
+			nc.bw.WriteString("PONG\r\n")
+			nc.bw.Flush()
+			nc.mu.Unlock()
+		case strings.HasPrefix(line, "INFO "):
+			var info serverInfo
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info); err == nil {
+				nc.mu.Lock()
+				nc.info = info
+				nc.setupHeaderCodecsLocked()
+				nc.mu.Unlock()
+			}
+		case strings.HasPrefix(line, "MSG "), strings.HasPrefix(line, "HMSG "):
+			if err := nc.processMsgLine(line); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// processMsgLine parses a MSG/HMSG protocol line and its payload, parses
+// any header block via decodeHeaderBlock (HPACK-compressed NATS/1.1 or
+// plaintext NATS/1.0), and dispatches the resulting Msg to the matching subscription.
+func (nc *Conn) processMsgLine(line string) error {
+	hmsg := strings.HasPrefix(line, "HMSG ")
+	fields := strings.Fields(line)
+
+	var subject, sidStr, reply string
+	var hdrLen, totalLen int
+	var err error
+
+	switch {
+	case hmsg && len(fields) == 5:
+		subject, sidStr = fields[1], fields[2]
+		hdrLen, err = strconv.Atoi(fields[3])
+		if err == nil {
+			totalLen, err = strconv.Atoi(fields[4])
+		}
+	case hmsg && len(fields) == 6:
+		subject, sidStr, reply = fields[1], fields[2], fields[3]
+		hdrLen, err = strconv.Atoi(fields[4])
+		if err == nil {
+			totalLen, err = strconv.Atoi(fields[5])
+		}
+	case !hmsg && len(fields) == 4:
+		subject, sidStr = fields[1], fields[2]
+		totalLen, err = strconv.Atoi(fields[3])
+	case !hmsg && len(fields) == 5:
+		subject, sidStr, reply = fields[1], fields[2], fields[3]
+		totalLen, err = strconv.Atoi(fields[4])
+	default:
+		return fmt.Errorf("nats: malformed protocol line %q", line)
+	}
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, totalLen+2)
+	if _, err := io.ReadFull(nc.br, buf); err != nil {
+		return err
+	}
+	buf = buf[:totalLen]
+
+	m := &Msg{Subject: subject, Reply: reply}
+	if hdrLen > 0 {
+		hdr, err := nc.decodeHeaderBlock(buf[:hdrLen])
+		if err != nil {
+			return err
+		}
+		m.Header = hdr
+		m.Data = buf[hdrLen:]
+	} else {
+		m.Data = buf
+	}
+
+	sid, err := strconv.ParseInt(sidStr, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	nc.mu.Lock()
+	sub := nc.subs[sid]
+	nc.mu.Unlock()
+	if sub == nil {
+		return nil
+	}
+	m.Sub = sub
+
+	if sub.mcb != nil {
+		sub.mcb(m)
+		return nil
+	}
+	select {
+	case sub.msgCh <- m:
+	default:
+	}
+	return nil
+}